@@ -0,0 +1,157 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/alexsward/steel/model"
+	"github.com/hashicorp/raft"
+)
+
+// applyTimeout bounds how long a single Raft log entry has to commit
+// before Cluster gives up on it.
+const applyTimeout = 5 * time.Second
+
+// Cluster wraps a Raft consensus group whose committed log is the FSM's
+// partition map and broker membership. Every mutating call below goes
+// through raft.Raft.Apply so the result is durable and replicated before
+// it is visible to callers.
+type Cluster struct {
+	raft *raft.Raft
+	fsm  *FSM
+}
+
+// New wraps an already-configured *raft.Raft instance (transport,
+// snapshot store and log store are deployment-specific, so callers build
+// those and pass the resulting Raft handle in here).
+func New(r *raft.Raft, fsm *FSM) *Cluster {
+	return &Cluster{raft: r, fsm: fsm}
+}
+
+// NewSingleNode bootstraps a brand-new, single-voter Raft cluster backed
+// by in-memory transport, log, stable and snapshot stores, and wraps it
+// in a Cluster. It's the minimum needed to make `manage addnode`/
+// `manage rebalance` durable and replayable within one process without
+// requiring a caller to wire up a real network transport first -- the
+// in-process analogue of store/embedded's BadgerDB-backed BlobStore.
+// Joining real remote peers still requires swapping in a network
+// transport, which this constructor doesn't provide.
+func NewSingleNode(id, address string) (*Cluster, error) {
+	cfg := raft.DefaultConfig()
+	cfg.LocalID = raft.ServerID(id)
+
+	_, transport := raft.NewInmemTransport(raft.ServerAddress(address))
+	logStore := raft.NewInmemStore()
+	stableStore := raft.NewInmemStore()
+	snapshots := raft.NewInmemSnapshotStore()
+
+	fsm := NewFSM()
+	r, err := raft.NewRaft(cfg, fsm, logStore, stableStore, snapshots, transport)
+	if err != nil {
+		return nil, fmt.Errorf("cluster: starting raft: %w", err)
+	}
+
+	bootstrap := raft.Configuration{
+		Servers: []raft.Server{
+			{ID: cfg.LocalID, Address: transport.LocalAddr()},
+		},
+	}
+	if err := r.BootstrapCluster(bootstrap).Error(); err != nil && err != raft.ErrCantBootstrap {
+		return nil, fmt.Errorf("cluster: bootstrapping: %w", err)
+	}
+
+	// A single-voter cluster elects itself leader almost immediately, but
+	// not instantaneously -- wait for it so the AddNode/Rebalance calls
+	// callers make right after this returns don't fail with "not the
+	// leader".
+	deadline := time.Now().Add(5 * time.Second)
+	for r.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("cluster: timed out waiting to become leader")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return New(r, fsm), nil
+}
+
+func (c *Cluster) apply(cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := c.raft.Apply(data, applyTimeout)
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("cluster: apply %s: %w", cmd.Type, err)
+	}
+	if err, ok := future.Response().(error); ok && err != nil {
+		return fmt.Errorf("cluster: apply %s: %w", cmd.Type, err)
+	}
+	return nil
+}
+
+// AddNode admits a new broker to the cluster. It does not by itself move
+// any partitions; call Rebalance afterward to spread load onto it.
+func (c *Cluster) AddNode(id, address string) error {
+	return c.apply(command{
+		Type: commandAddNode,
+		Node: Node{ID: id, Address: address},
+	})
+}
+
+// RemoveNode evicts a broker. Partitions it owned are left ownerless
+// until the next Rebalance picks new owners for them.
+func (c *Cluster) RemoveNode(id string) error {
+	return c.apply(command{Type: commandRemoveNode, NodeID: id})
+}
+
+// PartitionFor returns which partition the given key belongs to, out of
+// the supplied total partition count, and the node that currently owns
+// it.
+func (c *Cluster) PartitionFor(id model.Id, partitions int) (int, Node, error) {
+	p := id.Hash % partitions
+	if p < 0 {
+		p += partitions
+	}
+	n, err := c.fsm.state.NodeFor(p)
+	return p, n, err
+}
+
+// Migration describes one partition whose ownership is moving from one
+// broker to another as the result of a Rebalance.
+type Migration struct {
+	Partition int
+	From      string
+	To        string
+}
+
+// Rebalance recomputes partition ownership from current membership using
+// consistent hashing, commits the new assignment through Raft, and
+// returns the set of partitions that changed owner so the caller can
+// stream their contents with store.BlobStore.Migrate.
+func (c *Cluster) Rebalance(partitions int) ([]Migration, error) {
+	members, current := c.fsm.state.Snapshot()
+	assignments, err := assign(members, partitions)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for p, owner := range assignments {
+		prev := current[p]
+		if prev.Owner == owner {
+			continue
+		}
+		if err := c.apply(command{
+			Type:      commandAssignPartition,
+			Partition: Partition{ID: p, Owner: owner, Replicas: prev.Replicas},
+		}); err != nil {
+			return migrations, err
+		}
+		if prev.Owner != "" {
+			migrations = append(migrations, Migration{Partition: p, From: prev.Owner, To: owner})
+		}
+	}
+	return migrations, nil
+}
@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/raft"
+)
+
+type commandType string
+
+const (
+	commandAddNode         commandType = "add_node"
+	commandRemoveNode      commandType = "remove_node"
+	commandAssignPartition commandType = "assign_partition"
+)
+
+// command is the payload appended to the Raft log for every mutation.
+// Keeping it a single envelope type means FSM.Apply only needs one
+// unmarshal/dispatch, and new mutation kinds only need a new commandType.
+type command struct {
+	Type      commandType `json:"type"`
+	Node      Node        `json:"node,omitempty"`
+	NodeID    string      `json:"node_id,omitempty"`
+	Partition Partition   `json:"partition,omitempty"`
+}
+
+// FSM is the Raft finite state machine backing the cluster's partition
+// map. All writes to State go through Apply so every node in the Raft
+// group ends up with an identical copy.
+type FSM struct {
+	state *State
+}
+
+func NewFSM() *FSM {
+	return &FSM{state: NewState()}
+}
+
+func (f *FSM) Apply(log *raft.Log) interface{} {
+	var c command
+	if err := json.Unmarshal(log.Data, &c); err != nil {
+		return fmt.Errorf("cluster: invalid command in raft log: %w", err)
+	}
+
+	switch c.Type {
+	case commandAddNode:
+		f.state.addNode(c.Node)
+	case commandRemoveNode:
+		f.state.removeNode(c.NodeID)
+	case commandAssignPartition:
+		f.state.assignPartition(c.Partition)
+	default:
+		return fmt.Errorf("cluster: unknown command type %q", c.Type)
+	}
+	return nil
+}
+
+func (f *FSM) Snapshot() (raft.FSMSnapshot, error) {
+	members, partitions := f.state.Snapshot()
+	return &fsmSnapshot{Members: members, Partitions: partitions}, nil
+}
+
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap fsmSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+	state := NewState()
+	for _, n := range snap.Members {
+		state.addNode(n)
+	}
+	for _, p := range snap.Partitions {
+		state.assignPartition(p)
+	}
+	f.state = state
+	return nil
+}
+
+type fsmSnapshot struct {
+	Members    map[string]Node   `json:"members"`
+	Partitions map[int]Partition `json:"partitions"`
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
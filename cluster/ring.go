@@ -0,0 +1,68 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/alexsward/steel/model"
+)
+
+// virtualNodesPerMember controls how finely each broker's share of the
+// ring is subdivided. More virtual nodes means a new member takes a more
+// even slice of partitions away from existing owners.
+const virtualNodesPerMember = 64
+
+// ring is a consistent-hashing ring used to compute partition ownership
+// from live cluster membership, so that adding or removing a broker only
+// reshuffles the partitions it is directly responsible for.
+type ring struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash   int
+	nodeID string
+}
+
+func newRing(members map[string]Node) *ring {
+	r := &ring{}
+	for id := range members {
+		for v := 0; v < virtualNodesPerMember; v++ {
+			key := fmt.Sprintf("%s-%d", id, v)
+			r.points = append(r.points, ringPoint{
+				hash:   model.NewId(key).Hash,
+				nodeID: id,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// owner returns the node ID that should own the given partition.
+func (r *ring) owner(partition int) (string, error) {
+	if len(r.points) == 0 {
+		return "", fmt.Errorf("cluster: no live members to own partition %d", partition)
+	}
+	h := model.NewId(fmt.Sprintf("partition-%d", partition)).Hash
+	idx := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if idx == len(r.points) {
+		idx = 0
+	}
+	return r.points[idx].nodeID, nil
+}
+
+// assign computes an owner for each of the given partitions using
+// consistent hashing over the ring's virtual nodes.
+func assign(members map[string]Node, partitions int) (map[int]string, error) {
+	r := newRing(members)
+	out := make(map[int]string, partitions)
+	for p := 0; p < partitions; p++ {
+		owner, err := r.owner(p)
+		if err != nil {
+			return nil, err
+		}
+		out[p] = owner
+	}
+	return out, nil
+}
@@ -0,0 +1,101 @@
+// Package cluster holds the replicated membership and partition map for
+// Steel. State is kept consistent across brokers via Raft: every mutation
+// (node joining/leaving, partition reassignment) is committed to the Raft
+// log before it is considered durable, so any node can recover the
+// authoritative map by replaying the log or loading a snapshot. The map
+// records each partition's owner and replicas; it does not track a
+// separate per-partition leader.
+package cluster
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Node is a single broker participating in the cluster.
+type Node struct {
+	ID      string
+	Address string
+}
+
+// Partition describes which store.BlobStore owns a partition, and which
+// nodes hold replicas of it.
+type Partition struct {
+	ID       int
+	Owner    string
+	Replicas []string
+}
+
+// State is the authoritative, replicated view of cluster membership and
+// the partition map. It is only ever mutated through FSM.Apply so that
+// every node's copy stays in lock-step with the Raft log.
+type State struct {
+	mu         sync.RWMutex
+	Members    map[string]Node
+	Partitions map[int]Partition
+}
+
+// NewState returns an empty cluster state.
+func NewState() *State {
+	return &State{
+		Members:    make(map[string]Node),
+		Partitions: make(map[int]Partition),
+	}
+}
+
+func (s *State) addNode(n Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Members[n.ID] = n
+}
+
+func (s *State) removeNode(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Members, id)
+	for p, part := range s.Partitions {
+		if part.Owner == id {
+			part.Owner = ""
+			s.Partitions[p] = part
+		}
+	}
+}
+
+func (s *State) assignPartition(p Partition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Partitions[p.ID] = p
+}
+
+// NodeFor returns the node owning a partition, or an error if the
+// partition has no live owner.
+func (s *State) NodeFor(partition int) (Node, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	part, ok := s.Partitions[partition]
+	if !ok || part.Owner == "" {
+		return Node{}, fmt.Errorf("no owner for partition %d", partition)
+	}
+	n, ok := s.Members[part.Owner]
+	if !ok {
+		return Node{}, fmt.Errorf("owner %s for partition %d is not a known member", part.Owner, partition)
+	}
+	return n, nil
+}
+
+// Snapshot returns a deep copy of the current partition map, suitable for
+// handing to a rebalancing pass without holding the state lock.
+func (s *State) Snapshot() (map[string]Node, map[int]Partition) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	members := make(map[string]Node, len(s.Members))
+	for k, v := range s.Members {
+		members[k] = v
+	}
+	partitions := make(map[int]Partition, len(s.Partitions))
+	for k, v := range s.Partitions {
+		v.Replicas = append([]string(nil), v.Replicas...)
+		partitions[k] = v
+	}
+	return members, partitions
+}
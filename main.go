@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 
+	"github.com/alexsward/steel/cluster"
 	"github.com/alexsward/steel/store"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
@@ -30,10 +33,19 @@ func app() *cli.App {
 			return setupLogger(ctx)
 		},
 		Action: func(ctx *cli.Context) error {
+			// TODO: make all of this dynamic
+			backingStores := getBackingStoreConfiguration()
+
+			clus, err := buildCluster(backingStores)
+			if err != nil {
+				zap.L().Error("error bootstrapping cluster", zap.Error(err))
+				return err
+			}
+
 			s, err := NewService(&ServiceConfig{
-				// TODO: make all of this dynamic
-				BackingStores: getBackingStoreConfiguration(),
-				Partitioner:   MultiStorePartitionStrategy(2),
+				BackingStores: backingStores,
+				Partitioner:   ClusterPartitionStrategy(clus, len(backingStores)),
+				Cluster:       clus,
 			})
 			if err != nil {
 				zap.L().Error("error creating service", zap.Error(err))
@@ -46,7 +58,40 @@ func app() *cli.App {
 	}
 }
 
+// buildCluster bootstraps a single-node Raft cluster and registers each
+// configured backing store's partition as a cluster.Node under its
+// partition number, so ClusterPartitionStrategy's ownership lookups
+// resolve back to a local store from the moment the process starts. It
+// then runs an initial Rebalance so every partition has an owner before
+// the service starts accepting commands -- `manage rebalance` only
+// moves ownership again once membership actually changes.
+func buildCluster(stores []BackingStore) (*cluster.Cluster, error) {
+	c, err := cluster.NewSingleNode("local", "127.0.0.1:8391")
+	if err != nil {
+		return nil, fmt.Errorf("bootstrapping cluster: %w", err)
+	}
+	for _, bs := range stores {
+		if err := c.AddNode(strconv.Itoa(bs.Partition), bs.Address); err != nil {
+			return nil, fmt.Errorf("registering partition %d with cluster: %w", bs.Partition, err)
+		}
+	}
+	if _, err := c.Rebalance(len(stores)); err != nil {
+		return nil, fmt.Errorf("performing initial rebalance: %w", err)
+	}
+	return c, nil
+}
+
 func getBackingStoreConfiguration() []BackingStore {
+	// Running with an embedded BadgerDB store instead of redis is mostly
+	// useful for in-process integration tests and single-node/edge
+	// deployments, so it's opt-in via env var rather than a first-class
+	// flag until the rest of this configuration is made dynamic.
+	if path := os.Getenv("STEEL_BADGER_PATH"); path != "" {
+		return []BackingStore{
+			{Type: store.StoreTypeBadger, Partition: 0, Address: path},
+		}
+	}
+
 	stores := make([]BackingStore, 0)
 	stores = append(stores, BackingStore{
 		Type:      store.StoreTypeRedis,
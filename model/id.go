@@ -30,15 +30,37 @@ const (
 	Oldest VersionId = -1
 )
 
+// VersionMetadata is the caller-supplied part of a version record: the
+// bits a BlobStore can't derive from the content itself. It's passed to
+// Add/CompareAndSet and round-tripped back out through Versions. When is
+// normally left zero so Add stamps the write time itself; Migrate sets
+// it to the original version's When so a key's history keeps its real
+// timestamps instead of being rewritten to the migration time.
+type VersionMetadata struct {
+	ContentType string
+	Author      string
+	When        time.Time
+}
+
 type Version struct {
 	Id     VersionId
 	Hash   string
 	When   time.Time
 	Latest bool
+	// Size is the content length in bytes, recorded at write time.
+	Size int64
+	VersionMetadata
 }
 
 func (v Version) String() string {
-	return fmt.Sprintf("%d %s", v.Id, v.Hash)
+	contentType, author := v.ContentType, v.Author
+	if contentType == "" {
+		contentType = "-"
+	}
+	if author == "" {
+		author = "-"
+	}
+	return fmt.Sprintf("%d %s %d %s %s %s", v.Id, v.Hash, v.Size, v.When.Format(time.RFC3339), contentType, author)
 }
 
 func hashId(value []byte) int {
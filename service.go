@@ -1,23 +1,36 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
+	"github.com/alexsward/steel/cluster"
 	"github.com/alexsward/steel/model"
 	"github.com/alexsward/steel/store"
+	"github.com/alexsward/steel/store/embedded"
 	"github.com/alexsward/steel/store/redis"
 	"github.com/tidwall/redcon"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 )
 
+// defaultCommandTimeout bounds how long a single redcon command may run
+// before its context is cancelled, so a slow or stuck partition can't
+// hold a worker goroutine open indefinitely.
+const defaultCommandTimeout = 30 * time.Second
+
 type Service interface {
 	Run() error
 }
 
-// BackingStore, for now, is only redis
+// BackingStore describes one store.BlobStore partition. Address is a
+// redis "host:port" for StoreTypeRedis, or an on-disk directory for
+// StoreTypeBadger.
 type BackingStore struct {
 	Type      store.StoreType
 	Partition int
@@ -36,21 +49,68 @@ func MultiStorePartitionStrategy(partitions int) PartitionStrategy {
 	}
 }
 
+// ClusterPartitionStrategy routes a key by consulting the cluster's
+// replicated ownership map rather than recomputing a static hash: each
+// local store partition is registered as a cluster.Node (see
+// buildCluster), identified by its partition number as a string, so once
+// cluster.Cluster.Rebalance has assigned an owner, that owner's ID is
+// parsed straight back into the s.stores index to use. It falls back to
+// the same static hash MultiStorePartitionStrategy uses whenever the
+// partition has no live owner (before the first Rebalance, or after its
+// owner was removed) or the owner's ID is not a local partition index
+// (e.g. a node added with `manage addnode` under a non-numeric ID).
+func ClusterPartitionStrategy(c *cluster.Cluster, partitions int) PartitionStrategy {
+	return func(i model.Id) int {
+		p, owner, err := c.PartitionFor(i, partitions)
+		if err != nil {
+			zap.L().Warn("no cluster owner assigned yet, falling back to static hash", zap.Int("partition", p), zap.Error(err))
+			return p
+		}
+		local, err := strconv.Atoi(owner.ID)
+		if err != nil {
+			zap.L().Warn("cluster owner is not a local partition index, falling back to static hash", zap.Int("partition", p), zap.String("owner", owner.ID), zap.Error(err))
+			return p
+		}
+		return local
+	}
+}
+
 type ServiceConfig struct {
 	BackingStores []BackingStore
 	Partitioner   PartitionStrategy
+	// Cluster, when set, makes `manage addnode`/`manage rebalance` go
+	// through Raft-committed log entries, and makes `manage remove` also
+	// remove the partition's cluster node. When nil, `manage addnode` and
+	// `manage rebalance` return an error.
+	Cluster *cluster.Cluster
+	// CommandTimeout bounds how long any single command's store calls may
+	// run. Zero uses defaultCommandTimeout.
+	CommandTimeout time.Duration
 }
 
 func NewService(opts *ServiceConfig) (Service, error) {
 	if len(opts.BackingStores) == 0 {
 		return nil, fmt.Errorf("no backing stores supplied to Service")
 	}
+	timeout := opts.CommandTimeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
 	s := &service{
-		stores: make(map[int]store.BlobStore),
-		router: opts.Partitioner,
+		stores:         make(map[int]store.BlobStore),
+		router:         opts.Partitioner,
+		cluster:        opts.Cluster,
+		commandTimeout: timeout,
 	}
 	for _, bs := range opts.BackingStores {
-		st, err := NewRedisStore(redis.WithAddress(bs.Address), redis.AsParition(bs.Partition))
+		var st store.BlobStore
+		var err error
+		switch bs.Type {
+		case store.StoreTypeBadger:
+			st, err = NewBadgerStore(embedded.WithPath(bs.Address), embedded.AsPartition(bs.Partition))
+		default:
+			st, err = NewRedisStore(redis.WithAddress(bs.Address), redis.AsParition(bs.Partition))
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -60,8 +120,10 @@ func NewService(opts *ServiceConfig) (Service, error) {
 }
 
 type service struct {
-	stores map[int]store.BlobStore
-	router PartitionStrategy
+	stores         map[int]store.BlobStore
+	router         PartitionStrategy
+	cluster        *cluster.Cluster
+	commandTimeout time.Duration
 }
 
 func (s *service) Run() error {
@@ -83,6 +145,10 @@ func Keys[K comparable, V any](m map[K]V) []K {
 }
 
 func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.commandTimeout)
+	defer cancel()
+	conn.SetContext(cancel)
+
 	switch strings.ToLower(string(cmd.Args[0])) {
 	case "keys", "k":
 		if len(cmd.Args) < 2 {
@@ -109,22 +175,34 @@ func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
 			partitions = Keys(s.stores)
 		}
 
-		total := 0
-		results := make(map[int][]model.Id)
-		var wg sync.WaitGroup
-		wg.Add(len(partitions))
-		for _, part := range partitions {
-			go func(p int) {
-				keys, err := s.stores[p].Keys(pattern)
+		// Each partition gets its own result slot, indexed by position in
+		// partitions, so merging after Wait() needs no shared map/counter
+		// that concurrent goroutines would otherwise have to synchronize.
+		// Returning the error (rather than logging and swallowing it)
+		// lets errgroup cancel gctx as soon as the first partition fails,
+		// instead of leaving the rest to run to completion regardless.
+		results := make([][]model.Id, len(partitions))
+		g, gctx := errgroup.WithContext(ctx)
+		for i, part := range partitions {
+			i, part := i, part
+			g.Go(func() error {
+				keys, err := s.stores[part].Keys(gctx, pattern)
 				if err != nil {
-					zap.L().Error("error getting keys for partition", zap.Int("partition", p), zap.Error(err))
+					return fmt.Errorf("partition %d: %w", part, err)
 				}
-				results[p] = keys
-				total += len(keys)
-				wg.Done()
-			}(part)
+				results[i] = keys
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			conn.WriteError(fmt.Sprintf("error getting keys: %s", err))
+			return
+		}
+
+		total := 0
+		for _, keys := range results {
+			total += len(keys)
 		}
-		wg.Wait()
 
 		conn.WriteArray(total)
 		for _, keys := range results {
@@ -144,12 +222,75 @@ func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
 			conn.WriteError(fmt.Sprintf("unknown partition %d for id: %s", p, cmd.Args[1]))
 			return
 		}
-		err := partition.Add(id, cmd.Args[2])
+		err := partition.Add(ctx, id, cmd.Args[2], model.VersionMetadata{})
 		if err != nil {
 			conn.WriteError(fmt.Sprintf("error adding element: %s", err))
 			return
 		}
 		conn.WriteString("OK")
+	case "setm":
+		if len(cmd.Args) != 5 {
+			conn.WriteError(fmt.Sprintf("incorrect number of arguments to SETM: %d", len(cmd.Args)))
+			return
+		}
+		id := model.NewId(cmd.Args[1])
+		p := s.router(id)
+		partition, ok := s.stores[p]
+		if !ok {
+			conn.WriteError(fmt.Sprintf("unknown partition %d for id: %s", p, cmd.Args[1]))
+			return
+		}
+		meta := model.VersionMetadata{ContentType: string(cmd.Args[2]), Author: string(cmd.Args[3])}
+		if err := partition.Add(ctx, id, cmd.Args[4], meta); err != nil {
+			conn.WriteError(fmt.Sprintf("error adding element: %s", err))
+			return
+		}
+		conn.WriteString("OK")
+	case "cas", "setc":
+		if len(cmd.Args) != 4 {
+			conn.WriteError(fmt.Sprintf("incorrect number of arguments to CAS: %d", len(cmd.Args)))
+			return
+		}
+		id := model.NewId(cmd.Args[1])
+		p := s.router(id)
+		partition, ok := s.stores[p]
+		if !ok {
+			conn.WriteError(fmt.Sprintf("unknown partition %d for id: %s", p, cmd.Args[1]))
+			return
+		}
+		expected, err := strconv.Atoi(string(cmd.Args[2]))
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("invalid expected version supplied: %s", cmd.Args[2]))
+			return
+		}
+		version, err := partition.CompareAndSet(ctx, id, model.VersionId(expected), cmd.Args[3], model.VersionMetadata{})
+		if err != nil {
+			if errors.Is(err, store.ErrVersionConflict) {
+				conn.WriteError(fmt.Sprintf("ERR conflict: %s", err))
+				return
+			}
+			conn.WriteError(fmt.Sprintf("error in compare-and-set: %s", err))
+			return
+		}
+		conn.WriteInt(int(version))
+	case "getcv":
+		if len(cmd.Args) != 2 {
+			conn.WriteError(fmt.Sprintf("incorrect number of arguments to GETCV: %d", len(cmd.Args)))
+			return
+		}
+		id, partition, err := s.storeAndId(cmd.Args[1])
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		content, version, err := partition.GetWithVersion(ctx, id)
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("error retrieving element: %s", err))
+			return
+		}
+		conn.WriteArray(2)
+		conn.WriteInt(int(version))
+		conn.WriteBulkString(string(content))
 	case "get", "g":
 		if len(cmd.Args) != 2 {
 			conn.WriteError(fmt.Sprintf("incorrect number of arguments to GET: %d", len(cmd.Args)))
@@ -160,7 +301,7 @@ func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
 			conn.WriteError(err.Error())
 			return
 		}
-		v, err := partition.Get(id)
+		v, err := partition.Get(ctx, id)
 		if err != nil {
 			conn.WriteError(fmt.Sprintf("error retrieving element: %s", err))
 			return
@@ -182,7 +323,7 @@ func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
 			conn.WriteError(err.Error())
 			return
 		}
-		if v, err := store.GetVersion(id, version); err != nil {
+		if v, err := store.GetVersion(ctx, id, version); err != nil {
 			conn.WriteError(err.Error())
 		} else {
 			conn.WriteString(string(v))
@@ -202,13 +343,13 @@ func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
 				conn.WriteError(err.Error())
 				return
 			} else {
-				if err = partition.DeleteVersion(id, version); err != nil {
+				if err = partition.DeleteVersion(ctx, id, version); err != nil {
 					conn.WriteError(err.Error())
 					return
 				}
 			}
 		} else {
-			if err = partition.Delete(id); err != nil {
+			if err = partition.Delete(ctx, id); err != nil {
 				conn.WriteError(err.Error())
 				return
 			}
@@ -224,7 +365,7 @@ func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
 			conn.WriteError(err.Error())
 			return
 		}
-		versions, err := partition.Versions(id)
+		versions, err := partition.Versions(ctx, id)
 		if err != nil {
 			conn.WriteError(err.Error())
 			return
@@ -234,40 +375,130 @@ func (s *service) handler(conn redcon.Conn, cmd redcon.Command) {
 		for _, v := range versions {
 			conn.WriteBulkString(v.String())
 		}
+	case "meta":
+		if len(cmd.Args) < 2 || len(cmd.Args) > 3 {
+			conn.WriteError(fmt.Sprintf("incorrect number of arguments to META: %d", len(cmd.Args)))
+			return
+		}
+		id, partition, err := s.storeAndId(cmd.Args[1])
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		version := model.Latest
+		if len(cmd.Args) == 3 {
+			if version, err = getVersion(cmd.Args[2]); err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+		}
+		versions, err := partition.Versions(ctx, id)
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		idx, err := versionIndex(len(versions), version)
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		v := versions[idx]
+		conn.WriteArray(6)
+		conn.WriteBulkString(fmt.Sprintf("%d", v.Id))
+		conn.WriteBulkString(v.Hash)
+		conn.WriteBulkString(v.When.Format(time.RFC3339))
+		conn.WriteBulkString(fmt.Sprintf("%d", v.Size))
+		conn.WriteBulkString(v.ContentType)
+		conn.WriteBulkString(v.Author)
 	case "manage", "admin":
-		s.handleManagement(conn, cmd)
+		s.handleManagement(ctx, conn, cmd)
 	default:
 		conn.WriteError(fmt.Sprintf("ERR: Command %s not found", string(cmd.Args[0])))
 	}
 }
 
-func (s *service) handleManagement(conn redcon.Conn, cmd redcon.Command) {
+func (s *service) handleManagement(ctx context.Context, conn redcon.Conn, cmd redcon.Command) {
 	if len(cmd.Args) == 1 {
 		conn.WriteError("need to supply a subcommand")
 		return
 	}
 	switch strings.ToLower(string(cmd.Args[1])) {
 	case "remove":
-		if len(cmd.Args) < 2 {
-			conn.WriteError("invalid number of arguments, requires at least 2")
+		if len(cmd.Args) < 3 {
+			conn.WriteError("invalid number of arguments, requires at least one partition")
 			return
 		}
-		if partitions, err := getIntegers(cmd.Args[1:]); err != nil {
+		partitions, err := getIntegers(cmd.Args[2:])
+		if err != nil {
 			conn.WriteError(err.Error())
 			return
-		} else {
-			conn.WriteArray(2)
-			for _, part := range partitions {
-				delete(s.stores, part)
-				conn.WriteBulkString(fmt.Sprintf("removed partition %d", part))
+		}
+		conn.WriteArray(len(partitions))
+		for _, part := range partitions {
+			if s.cluster != nil {
+				if err := s.cluster.RemoveNode(strconv.Itoa(part)); err != nil {
+					zap.L().Error("error removing cluster node for partition", zap.Int("partition", part), zap.Error(err))
+				}
 			}
+			delete(s.stores, part)
+			conn.WriteBulkString(fmt.Sprintf("removed partition %d", part))
 		}
 	case "purge":
 	case "rebalance":
-		if len(cmd.Args) != 3 {
-			conn.WriteError("required arguments: 1 -- FROM partition")
+		if s.cluster == nil {
+			conn.WriteError("rebalance requires a cluster-enabled service")
 			return
 		}
+		migrations, err := s.cluster.Rebalance(len(s.stores))
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("error rebalancing: %s", err))
+			return
+		}
+		for _, m := range migrations {
+			if err := s.migratePartition(ctx, m); err != nil {
+				zap.L().Error("error migrating partition after rebalance", zap.Int("partition", m.Partition), zap.String("from", m.From), zap.String("to", m.To), zap.Error(err))
+			}
+		}
+		conn.WriteArray(len(migrations))
+		for _, m := range migrations {
+			conn.WriteBulkString(fmt.Sprintf("partition %d: %s -> %s", m.Partition, m.From, m.To))
+		}
+	case "addnode":
+		if s.cluster == nil {
+			conn.WriteError("addnode requires a cluster-enabled service")
+			return
+		}
+		if len(cmd.Args) != 4 {
+			conn.WriteError("required arguments: node id, address")
+			return
+		}
+		if err := s.cluster.AddNode(string(cmd.Args[2]), string(cmd.Args[3])); err != nil {
+			conn.WriteError(fmt.Sprintf("error adding node: %s", err))
+			return
+		}
+		conn.WriteString("OK")
+	case "replicate":
+		if len(cmd.Args) != 4 {
+			conn.WriteError("required arguments: partition, replication factor")
+			return
+		}
+		partition, err := strconv.Atoi(string(cmd.Args[2]))
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("invalid partition supplied: %s", cmd.Args[2]))
+			return
+		}
+		factor, err := strconv.Atoi(string(cmd.Args[3]))
+		if err != nil {
+			conn.WriteError(fmt.Sprintf("invalid replication factor supplied: %s", cmd.Args[3]))
+			return
+		}
+		src, ok := s.stores[partition]
+		if !ok {
+			conn.WriteError(fmt.Sprintf("unknown partition %d", partition))
+			return
+		}
+		go s.replicateContent(partition, src, factor)
+		conn.WriteString("OK")
 	case "partitions":
 		conn.WriteArray(len(s.stores))
 		for p := range s.stores {
@@ -276,6 +507,140 @@ func (s *service) handleManagement(conn redcon.Conn, cmd redcon.Command) {
 	}
 }
 
+// migratePartition streams the keys of partition m.Partition from its
+// former local store to its new owner's local store, using
+// store.BlobStore.Migrate, after Rebalance has already committed the new
+// assignment to the Raft log. m.From/m.To are cluster.Node IDs, which --
+// per ClusterPartitionStrategy -- are the local partition index they
+// were registered under, so they double as a lookup key into s.stores.
+func (s *service) migratePartition(ctx context.Context, m cluster.Migration) error {
+	from, err := strconv.Atoi(m.From)
+	if err != nil {
+		return fmt.Errorf("migrate partition %d: former owner %q is not a local partition index: %w", m.Partition, m.From, err)
+	}
+	to, err := strconv.Atoi(m.To)
+	if err != nil {
+		return fmt.Errorf("migrate partition %d: new owner %q is not a local partition index: %w", m.Partition, m.To, err)
+	}
+	src, ok := s.stores[from]
+	if !ok {
+		return fmt.Errorf("migrate partition %d: no local store for former owner %d", m.Partition, from)
+	}
+	dst, ok := s.stores[to]
+	if !ok {
+		return fmt.Errorf("migrate partition %d: no local store for new owner %d", m.Partition, to)
+	}
+
+	ids, err := src.Keys(ctx, "*")
+	if err != nil {
+		return fmt.Errorf("migrate partition %d: listing keys: %w", m.Partition, err)
+	}
+	// A store has no per-partition tag on its keys, so the only way to
+	// tell which of them actually belong to m.Partition is to recompute
+	// the same static hash bucket MultiStorePartitionStrategy assigned
+	// it at write time -- a former owner can hold several partitions'
+	// worth of keys, and only this one moved.
+	bucket := MultiStorePartitionStrategy(len(s.stores))
+	for _, id := range ids {
+		if bucket(id) != m.Partition {
+			continue
+		}
+		if err := src.Migrate(ctx, id, dst); err != nil {
+			return fmt.Errorf("migrate partition %d: %w", m.Partition, err)
+		}
+	}
+	return nil
+}
+
+// replicateContent asynchronously mirrors every content blob owned by
+// partition (by hash, not by id/version list) onto factor-1 other
+// partitions, so losing a partition's redis instance doesn't lose its
+// content as long as one replica survives. It does not touch version
+// lists: a partition still only "owns" a key's history through its own
+// list, replicas are purely for blob recovery. It writes replicas with
+// PutReplica rather than Put, since a replica has no corresponding
+// version-list entry (and therefore no Release) on the target
+// partition -- refcounting it the normal way would pin it forever, and
+// re-running replication would inflate the count further.
+//
+// It runs detached from whatever command requested it (the caller
+// already returned "OK" before this starts), so it gets its own
+// background context rather than the triggering command's, which is
+// cancelled as soon as that command's handler returns.
+func (s *service) replicateContent(partition int, src store.BlobStore, factor int) {
+	ctx := context.Background()
+
+	source, ok := src.(store.ContentSource)
+	if !ok {
+		zap.L().Error("partition does not support content replication", zap.Int("partition", partition))
+		return
+	}
+
+	targets := s.replicationTargets(partition, factor-1)
+	if len(targets) == 0 {
+		zap.L().Warn("no replication targets available", zap.Int("partition", partition))
+		return
+	}
+
+	ids, err := src.Keys(ctx, "*")
+	if err != nil {
+		zap.L().Error("error listing keys for replication", zap.Int("partition", partition), zap.Error(err))
+		return
+	}
+
+	for _, id := range ids {
+		versions, err := src.Versions(ctx, id)
+		if err != nil {
+			zap.L().Error("error listing versions for replication", zap.String("id", id.String()), zap.Error(err))
+			continue
+		}
+		for _, v := range versions {
+			content, err := source.Content().Get(ctx, v.Hash)
+			if err != nil {
+				zap.L().Error("error reading blob for replication", zap.String("hash", v.Hash), zap.Error(err))
+				continue
+			}
+			for _, t := range targets {
+				dst, ok := t.(store.ContentSource)
+				if !ok {
+					continue
+				}
+				if err := dst.Content().PutReplica(ctx, v.Hash, content); err != nil {
+					zap.L().Error("error replicating blob", zap.String("hash", v.Hash), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// replicationTargets picks the next n live partitions after source, in
+// partition-id order wrapping around, to act as content replicas.
+func (s *service) replicationTargets(source, n int) []store.BlobStore {
+	if n <= 0 {
+		return nil
+	}
+	parts := Keys(s.stores)
+	sort.Ints(parts)
+
+	start := 0
+	for i, p := range parts {
+		if p == source {
+			start = i
+			break
+		}
+	}
+
+	targets := make([]store.BlobStore, 0, n)
+	for i := 1; i < len(parts) && len(targets) < n; i++ {
+		p := parts[(start+i)%len(parts)]
+		if p == source {
+			continue
+		}
+		targets = append(targets, s.stores[p])
+	}
+	return targets
+}
+
 func (s *service) getPartition(id model.Id) (store.BlobStore, error) {
 	p := s.router(id)
 	partition, ok := s.stores[p]
@@ -296,12 +661,19 @@ func (s *service) accept(conn redcon.Conn) bool {
 }
 
 func (s *service) closed(conn redcon.Conn, err error) {
+	if cancel, ok := conn.Context().(context.CancelFunc); ok {
+		cancel()
+	}
 }
 
 func NewRedisStore(opts ...redis.Option) (*redis.Store, error) {
 	return redis.NewStore(opts...)
 }
 
+func NewBadgerStore(opts ...embedded.Option) (*embedded.Store, error) {
+	return embedded.NewStore(opts...)
+}
+
 func getVersion(raw []byte) (model.VersionId, error) {
 	version := model.Latest
 	switch strings.ToLower(string(raw)) {
@@ -319,6 +691,21 @@ func getVersion(raw []byte) (model.VersionId, error) {
 	return version, nil
 }
 
+// versionIndex maps a model.VersionId the same way GetVersion/LIndex do
+// onto an index into a count-length Versions() slice, so META can look
+// up the right entry by the same LATEST/OLDEST/N version flags accepted
+// elsewhere.
+func versionIndex(count int, version model.VersionId) (int, error) {
+	idx := int(version)
+	if idx < 0 {
+		idx = count + idx
+	}
+	if idx < 0 || idx >= count {
+		return 0, fmt.Errorf("version out of range")
+	}
+	return idx, nil
+}
+
 func getIntegers(raw [][]byte) ([]int, error) {
 	is := make([]int, len(raw))
 	for idx, b := range raw {
@@ -0,0 +1,34 @@
+package store
+
+import "context"
+
+// ContentStore is a reference-counted, content-addressed blob layer. It
+// is deliberately separate from a BlobStore's id -> version-list
+// mapping: several ids, and once replicated, several partitions, can all
+// point at the same content hash without the bytes being duplicated.
+type ContentStore interface {
+	// Put stores content under hash if it is not already present, and
+	// increments hash's reference count.
+	Put(ctx context.Context, hash string, content []byte) error
+	// PutReplica stores content under hash if it is not already present,
+	// the same as Put, but does not touch hash's reference count.
+	// Replicas exist so a partition's content survives losing its other
+	// copies, not to keep content alive past its real owner's Release --
+	// `manage replicate` uses this instead of Put so mirroring a
+	// partition, or re-running replication, doesn't inflate refcounts it
+	// has no corresponding Release for.
+	PutReplica(ctx context.Context, hash string, content []byte) error
+	// Get returns the content stored under hash.
+	Get(ctx context.Context, hash string) ([]byte, error)
+	// Release decrements hash's reference count, deleting the content
+	// once the count reaches zero.
+	Release(ctx context.Context, hash string) error
+}
+
+// ContentSource is implemented by BlobStore backends that expose their
+// underlying ContentStore, so operations like `manage replicate` can
+// mirror content blobs directly by hash instead of going through the
+// id/version-list API.
+type ContentSource interface {
+	Content() ContentStore
+}
@@ -0,0 +1,98 @@
+package embedded
+
+import (
+	"encoding/binary"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+func contentKey(hash string) []byte {
+	return []byte("content:" + hash)
+}
+
+func refcountKey(hash string) []byte {
+	return []byte("refcount:" + hash)
+}
+
+// putContent stores content under hash if it isn't already present, and
+// increments hash's reference count, all within the caller's Badger
+// transaction so it commits atomically with whatever version-list
+// mutation it accompanies.
+func putContent(txn *badger.Txn, hash string, content []byte) error {
+	count, err := getRefcount(txn, hash)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		if err := txn.Set(contentKey(hash), content); err != nil {
+			return err
+		}
+	}
+	return setRefcount(txn, hash, count+1)
+}
+
+// releaseContent decrements hash's reference count, deleting the content
+// once it reaches zero.
+func releaseContent(txn *badger.Txn, hash string) error {
+	count, err := getRefcount(txn, hash)
+	if err != nil {
+		return err
+	}
+	if count <= 1 {
+		if err := txn.Delete(contentKey(hash)); err != nil {
+			return err
+		}
+		return txn.Delete(refcountKey(hash))
+	}
+	return setRefcount(txn, hash, count-1)
+}
+
+// putReplicaContent stores content under hash if it isn't already
+// present, the same as putContent, but does not touch its reference
+// count: replica copies exist to survive partition loss, not to keep
+// content alive past the real owner's refcount reaching zero.
+func putReplicaContent(txn *badger.Txn, hash string, content []byte) error {
+	_, err := txn.Get(contentKey(hash))
+	if err == nil {
+		return nil
+	}
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+	return txn.Set(contentKey(hash), content)
+}
+
+func getContent(txn *badger.Txn, hash string) ([]byte, error) {
+	item, err := txn.Get(contentKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	err = item.Value(func(val []byte) error {
+		out = append([]byte{}, val...)
+		return nil
+	})
+	return out, err
+}
+
+func getRefcount(txn *badger.Txn, hash string) (uint64, error) {
+	item, err := txn.Get(refcountKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var count uint64
+	err = item.Value(func(val []byte) error {
+		count = binary.BigEndian.Uint64(val)
+		return nil
+	})
+	return count, err
+}
+
+func setRefcount(txn *badger.Txn, hash string, count uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, count)
+	return txn.Set(refcountKey(hash), buf)
+}
@@ -0,0 +1,443 @@
+// Package embedded provides a store.BlobStore backed by an embedded
+// BadgerDB instance instead of an external redis process, so Steel can
+// run single-node (or in-process, for tests) without any other service
+// to stand up.
+package embedded
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/alexsward/steel/model"
+	"github.com/alexsward/steel/store"
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+type Store struct {
+	partition int
+	path      string
+	db        *badger.DB
+}
+
+type Option func(*Store) error
+
+func WithPath(path string) Option {
+	return func(s *Store) error {
+		s.path = path
+		return nil
+	}
+}
+
+func AsPartition(p int) Option {
+	return func(s *Store) error {
+		s.partition = p
+		return nil
+	}
+}
+
+func NewStore(opts ...Option) (*Store, error) {
+	s := &Store{}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(s.path).WithLogger(nil))
+	if err != nil {
+		return nil, fmt.Errorf("opening badger store at %s: %w", s.path, err)
+	}
+	s.db = db
+
+	return s, nil
+}
+
+// Close releases the underlying BadgerDB. There's no equivalent on
+// store.BlobStore since redis connections don't need one, but callers
+// that know they hold an *embedded.Store should call it on shutdown.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Content exposes the partition's underlying store.ContentStore so
+// cross-partition operations like `manage replicate` can mirror blobs by
+// hash without going through the id/version-list API.
+func (s *Store) Content() store.ContentStore {
+	return &contentView{db: s.db}
+}
+
+func versionListKey(id model.Id) []byte {
+	return []byte("versions:" + id.String())
+}
+
+// record is what's actually stored per entry in a version list: the
+// content hash plus the metadata that can't be recovered from the hash
+// alone.
+type record struct {
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	When        time.Time `json:"when"`
+	ContentType string    `json:"contentType,omitempty"`
+	Author      string    `json:"author,omitempty"`
+}
+
+func readList(txn *badger.Txn, id model.Id) ([]record, error) {
+	item, err := txn.Get(versionListKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []record
+	err = item.Value(func(val []byte) error {
+		return json.Unmarshal(val, &list)
+	})
+	return list, err
+}
+
+func writeList(txn *badger.Txn, id model.Id, list []record) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return txn.Set(versionListKey(id), data)
+}
+
+// resolveIndex maps a model.VersionId onto an index into list, the same
+// way redis.Store's use of LIndex does: 0 is the head (most recent,
+// model.Latest), and negative indices count from the tail, so
+// model.Oldest (-1) is the last element.
+func resolveIndex(list []record, version model.VersionId) (int, error) {
+	idx := int(version)
+	if idx < 0 {
+		idx = len(list) + idx
+	}
+	if idx < 0 || idx >= len(list) {
+		return 0, store.ErrVersionNotFound
+	}
+	return idx, nil
+}
+
+// Keys, and every other Store method, take a ctx for interface
+// compliance with store.BlobStore, but Badger transactions have no
+// native way to abort mid-flight the way a redis connection can be
+// closed out from under a blocking call. The best this backend can do
+// is refuse to start if ctx is already done.
+func (s *Store) Keys(ctx context.Context, pattern string) ([]model.Id, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	prefix := []byte("versions:")
+	var ids []model.Id
+	err := s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := string(it.Item().Key()[len(prefix):])
+			matched, err := filepath.Match(pattern, key)
+			if err != nil {
+				return err
+			}
+			if matched {
+				ids = append(ids, model.NewId(key))
+			}
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (s *Store) Add(ctx context.Context, id model.Id, content []byte, meta model.VersionMetadata) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	when := meta.When
+	if when.IsZero() {
+		when = time.Now()
+	}
+	hashed := s.Hash(content)
+	rec := record{
+		Hash:        hashed,
+		Size:        int64(len(content)),
+		When:        when,
+		ContentType: meta.ContentType,
+		Author:      meta.Author,
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		list, err := readList(txn, id)
+		if err != nil {
+			return err
+		}
+		list = append([]record{rec}, list...)
+		if err := writeList(txn, id, list); err != nil {
+			return err
+		}
+		return putContent(txn, hashed, content)
+	})
+}
+
+func (s *Store) Get(ctx context.Context, id model.Id) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var content []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		list, err := readList(txn, id)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return store.ErrVersionNotFound
+		}
+		content, err = getContent(txn, list[0].Hash)
+		return err
+	})
+	return content, err
+}
+
+func (s *Store) GetVersion(ctx context.Context, id model.Id, version model.VersionId) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var content []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		list, err := readList(txn, id)
+		if err != nil {
+			return err
+		}
+		idx, err := resolveIndex(list, version)
+		if err != nil {
+			return err
+		}
+		content, err = getContent(txn, list[idx].Hash)
+		return err
+	})
+	return content, err
+}
+
+func (s *Store) GetWithVersion(ctx context.Context, id model.Id) ([]byte, model.VersionId, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	var content []byte
+	var length int
+	err := s.db.View(func(txn *badger.Txn) error {
+		list, err := readList(txn, id)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return store.ErrVersionNotFound
+		}
+		length = len(list)
+		content, err = getContent(txn, list[0].Hash)
+		return err
+	})
+	return content, model.VersionId(length), err
+}
+
+// CompareAndSet relies on Badger's own optimistic-transaction conflict
+// detection for the "has anything else written to this key" check, on
+// top of the explicit length comparison against expected -- mirroring
+// the WATCH-based guard in redis.Store.CompareAndSet. badger.ErrConflict
+// is what db.Update returns when that detection fires, so it's mapped
+// to store.ErrVersionConflict the same as the explicit length check,
+// keeping CAS conflict semantics consistent across backends.
+func (s *Store) CompareAndSet(ctx context.Context, id model.Id, expected model.VersionId, content []byte, meta model.VersionMetadata) (model.VersionId, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	hashed := s.Hash(content)
+	rec := record{
+		Hash:        hashed,
+		Size:        int64(len(content)),
+		When:        time.Now(),
+		ContentType: meta.ContentType,
+		Author:      meta.Author,
+	}
+	var result model.VersionId
+	err := s.db.Update(func(txn *badger.Txn) error {
+		list, err := readList(txn, id)
+		if err != nil {
+			return err
+		}
+		if model.VersionId(len(list)) != expected {
+			return store.ErrVersionConflict
+		}
+		list = append([]record{rec}, list...)
+		if err := writeList(txn, id, list); err != nil {
+			return err
+		}
+		if err := putContent(txn, hashed, content); err != nil {
+			return err
+		}
+		result = expected + 1
+		return nil
+	})
+	if errors.Is(err, badger.ErrConflict) {
+		return 0, store.ErrVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+func (s *Store) Versions(ctx context.Context, id model.Id) ([]model.Version, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var list []record
+	err := s.db.View(func(txn *badger.Txn) error {
+		l, err := readList(txn, id)
+		list = l
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]model.Version, len(list))
+	for i, rec := range list {
+		versions[i] = model.Version{
+			Id:              model.VersionId(i + 1),
+			Hash:            rec.Hash,
+			When:            rec.When,
+			Latest:          i == 0,
+			Size:            rec.Size,
+			VersionMetadata: model.VersionMetadata{ContentType: rec.ContentType, Author: rec.Author},
+		}
+	}
+	return versions, nil
+}
+
+func (s *Store) Delete(ctx context.Context, id model.Id) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		list, err := readList(txn, id)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(versionListKey(id)); err != nil {
+			return err
+		}
+		for _, rec := range list {
+			if err := releaseContent(txn, rec.Hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) DeleteVersion(ctx context.Context, id model.Id, version model.VersionId) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		list, err := readList(txn, id)
+		if err != nil {
+			return err
+		}
+		idx, err := resolveIndex(list, version)
+		if err != nil {
+			return err
+		}
+		hash := list[idx].Hash
+		list = append(list[:idx], list[idx+1:]...)
+		if err := writeList(txn, id, list); err != nil {
+			return err
+		}
+		return releaseContent(txn, hash)
+	})
+}
+
+func (s *Store) Migrate(ctx context.Context, id model.Id, dst store.BlobStore) error {
+	versions, err := s.Versions(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- { // oldest first
+		content, err := s.GetVersion(ctx, id, versions[i].Id-1)
+		if err != nil {
+			return fmt.Errorf("migrate %s: reading version %d: %w", id.String(), versions[i].Id, err)
+		}
+		// Carry the original When across explicitly -- Add would
+		// otherwise stamp the migration time as this version's write
+		// time, losing the real history chunk0-5 added VersionMetadata
+		// to preserve.
+		meta := versions[i].VersionMetadata
+		meta.When = versions[i].When
+		if err := dst.Add(ctx, id, content, meta); err != nil {
+			return fmt.Errorf("migrate %s: writing version %d: %w", id.String(), versions[i].Id, err)
+		}
+	}
+
+	return s.Delete(ctx, id)
+}
+
+func (s *Store) Hash(contents []byte) string {
+	h := sha1.New()
+	h.Write(contents)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type contentView struct {
+	db *badger.DB
+}
+
+func (c *contentView) Put(ctx context.Context, hash string, content []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.db.Update(func(txn *badger.Txn) error {
+		return putContent(txn, hash, content)
+	})
+}
+
+func (c *contentView) PutReplica(ctx context.Context, hash string, content []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.db.Update(func(txn *badger.Txn) error {
+		return putReplicaContent(txn, hash, content)
+	})
+}
+
+func (c *contentView) Get(ctx context.Context, hash string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var out []byte
+	err := c.db.View(func(txn *badger.Txn) error {
+		v, err := getContent(txn, hash)
+		out = v
+		return err
+	})
+	return out, err
+}
+
+func (c *contentView) Release(ctx context.Context, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.db.Update(func(txn *badger.Txn) error {
+		return releaseContent(txn, hash)
+	})
+}
+
+var (
+	_ store.BlobStore     = (*Store)(nil)
+	_ store.ContentSource = (*Store)(nil)
+	_ store.ContentStore  = (*contentView)(nil)
+)
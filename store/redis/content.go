@@ -0,0 +1,61 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/alexsward/steel/store"
+	rdb "github.com/redis/go-redis/v9"
+)
+
+// contentStore is the redis-backed store.ContentStore: content lives at
+// key hash, and a parallel "refcount:"+hash key tracks how many
+// version-list entries currently reference it.
+type contentStore struct {
+	client *rdb.Client
+}
+
+func newContentStore(client *rdb.Client) *contentStore {
+	return &contentStore{client: client}
+}
+
+func refcountKey(hash string) string {
+	return "refcount:" + hash
+}
+
+func (c *contentStore) Put(ctx context.Context, hash string, content []byte) error {
+	pipe := c.client.TxPipeline()
+	pipe.SetNX(ctx, hash, content, 0)
+	pipe.Incr(ctx, refcountKey(hash))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *contentStore) PutReplica(ctx context.Context, hash string, content []byte) error {
+	return c.client.SetNX(ctx, hash, content, 0).Err()
+}
+
+func (c *contentStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	v, err := c.client.Get(ctx, hash).Result()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(v), nil
+}
+
+func (c *contentStore) Release(ctx context.Context, hash string) error {
+	count, err := c.client.Decr(ctx, refcountKey(hash)).Result()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	pipe := c.client.TxPipeline()
+	pipe.Del(ctx, hash)
+	pipe.Del(ctx, refcountKey(hash))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+var _ store.ContentStore = (*contentStore)(nil)
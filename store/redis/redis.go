@@ -4,6 +4,9 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/alexsward/steel/model"
@@ -16,6 +19,7 @@ type Store struct {
 	partition int
 	address   string
 	client    *rdb.Client
+	content   *contentStore
 }
 
 type Option func(*Store) error
@@ -45,12 +49,38 @@ func NewStore(opts ...Option) (*Store, error) {
 	store.client = rdb.NewClient(&rdb.Options{
 		Addr: store.address,
 	})
+	store.content = newContentStore(store.client)
 
 	return store, nil
 }
 
-func (s *Store) Keys(pattern string) ([]model.Id, error) {
-	keys, err := s.client.Keys(context.Background(), pattern).Result()
+// Content exposes the partition's underlying store.ContentStore so
+// cross-partition operations like `manage replicate` can mirror blobs by
+// hash without going through the id/version-list API.
+func (s *Store) Content() store.ContentStore {
+	return s.content
+}
+
+// record is what's actually stored in a version list: the content hash,
+// plus the metadata that can't be recovered from the hash alone. It
+// replaces the old layout where the list held bare hashes, which is why
+// Versions used to have to fabricate When on every call.
+type record struct {
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	When        time.Time `json:"when"`
+	ContentType string    `json:"contentType,omitempty"`
+	Author      string    `json:"author,omitempty"`
+}
+
+func decodeRecord(raw string) (record, error) {
+	var r record
+	err := json.Unmarshal([]byte(raw), &r)
+	return r, err
+}
+
+func (s *Store) Keys(ctx context.Context, pattern string) ([]model.Id, error) {
+	keys, err := s.client.Keys(ctx, pattern).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -61,121 +91,240 @@ func (s *Store) Keys(pattern string) ([]model.Id, error) {
 	return r, nil
 }
 
-func (s *Store) Add(id model.Id, content []byte) error {
+// Add writes the new version record, the content (if not already
+// present), and its refcount increment inside a single MULTI/EXEC --
+// the same queued-pipeline shape CompareAndSet uses -- rather than two
+// separate round-trips with a best-effort compensating Release, so a
+// crash between them can't leave a refcounted blob with no version
+// entry pointing at it.
+func (s *Store) Add(ctx context.Context, id model.Id, content []byte, meta model.VersionMetadata) error {
 	zap.L().Info("ADD", zap.String("id", id.String()), zap.Binary("data", content), zap.Int("partition", s.partition))
 
-	hashed := s.Hash(content)
-
-	// TODO: do this in a txn
-	ex := s.client.Exists(context.Background(), hashed)
-	if ex.Err() != nil {
-		return ex.Err()
+	when := meta.When
+	if when.IsZero() {
+		when = time.Now()
 	}
-	if exists, err := ex.Result(); err != nil {
-		return err
-	} else if exists == 1 {
-		return nil // already exists, don't need to do anything
+	hashed := s.Hash(content)
+	rec := record{
+		Hash:        hashed,
+		Size:        int64(len(content)),
+		When:        when,
+		ContentType: meta.ContentType,
+		Author:      meta.Author,
 	}
-
-	pipe := s.client.Pipeline()
-	lpush := pipe.LPush(context.Background(), id.String(), hashed)
-	set := pipe.Set(context.Background(), hashed, content, 0)
-	if _, err := pipe.Exec(context.Background()); err != nil {
+	data, err := json.Marshal(rec)
+	if err != nil {
 		return err
 	}
-	if lpush.Err() != nil {
-		return lpush.Err()
-	}
-	if set.Err() != nil {
-		return set.Err()
-	}
 
-	return nil
+	_, err = s.client.TxPipelined(ctx, func(pipe rdb.Pipeliner) error {
+		pipe.LPush(ctx, id.String(), data)
+		pipe.SetNX(ctx, hashed, content, 0)
+		pipe.Incr(ctx, refcountKey(hashed))
+		return nil
+	})
+	return err
 }
 
-func (s *Store) Get(id model.Id) ([]byte, error) {
+func (s *Store) Get(ctx context.Context, id model.Id) ([]byte, error) {
 	zap.L().Info("GET", zap.String("id", id.String()), zap.Int("partition", s.partition))
+	return s.GetVersion(ctx, id, model.Latest)
+}
 
-	latest := s.client.LIndex(context.Background(), id.String(), 0)
-	l, err := latest.Result()
+func (s *Store) GetVersion(ctx context.Context, id model.Id, version model.VersionId) ([]byte, error) {
+	raw, err := s.client.LIndex(ctx, id.String(), int64(version)).Result()
 	if err != nil {
+		if err == rdb.Nil {
+			return nil, store.ErrVersionNotFound
+		}
 		return nil, err
 	}
-
-	zap.L().Info("Latest for key", zap.String("id", id.String()), zap.String("latest", l))
-
-	v, err := s.client.Get(context.Background(), l).Result()
+	rec, err := decodeRecord(raw)
+	if err != nil {
+		return nil, fmt.Errorf("decoding version record for %s: %w", id.String(), err)
+	}
+	v, err := s.client.Get(ctx, rec.Hash).Result()
 	if err != nil {
-		zap.L().Error("Error getting latest", zap.Error(err))
 		return nil, err
 	}
-
-	zap.L().Info("Got back", zap.String("id", id.String()), zap.String("raw", v))
-
 	return []byte(v), nil
 }
 
-func (s *Store) GetVersion(id model.Id, version model.VersionId) ([]byte, error) {
-	k, err := s.client.LIndex(context.Background(), id.String(), int64(version)).Result()
+func (s *Store) GetWithVersion(ctx context.Context, id model.Id) ([]byte, model.VersionId, error) {
+	content, err := s.Get(ctx, id)
 	if err != nil {
-		if err == rdb.Nil {
-			return nil, store.ErrVersionNotFound
-		}
-		return nil, err
+		return nil, 0, err
 	}
-	v, err := s.client.Get(context.Background(), k).Result()
+	length, err := s.client.LLen(ctx, id.String()).Result()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return []byte(v), nil
+	return content, model.VersionId(length), nil
+}
+
+// CompareAndSet performs the redis equivalent of the etcd/apiserver
+// "guaranteed update" loop: it WATCHes the version list key, and only if
+// its length still equals expected (i.e. nobody has written since the
+// caller's GetWithVersion) does it LPUSH the new version record and
+// write the content, all inside MULTI/EXEC. If the head has moved, the
+// transaction is discarded and store.ErrVersionConflict is returned so
+// the caller can re-read and retry.
+func (s *Store) CompareAndSet(ctx context.Context, id model.Id, expected model.VersionId, content []byte, meta model.VersionMetadata) (model.VersionId, error) {
+	key := id.String()
+	hashed := s.Hash(content)
+	rec := record{
+		Hash:        hashed,
+		Size:        int64(len(content)),
+		When:        time.Now(),
+		ContentType: meta.ContentType,
+		Author:      meta.Author,
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+
+	var result model.VersionId
+	txf := func(tx *rdb.Tx) error {
+		length, err := tx.LLen(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if model.VersionId(length) != expected {
+			return store.ErrVersionConflict
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe rdb.Pipeliner) error {
+			pipe.LPush(ctx, key, data)
+			pipe.SetNX(ctx, hashed, content, 0)
+			pipe.Incr(ctx, refcountKey(hashed))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		result = expected + 1
+		return nil
+	}
+
+	if err := s.client.Watch(ctx, txf, key); err != nil {
+		// TxFailedErr is what Watch returns when the key changed between
+		// WATCH and EXEC -- i.e. exactly the race this CAS guards
+		// against -- so it's a conflict just as much as the explicit
+		// length check above, and must retry the same way.
+		if errors.Is(err, store.ErrVersionConflict) || errors.Is(err, rdb.TxFailedErr) {
+			return 0, store.ErrVersionConflict
+		}
+		return 0, err
+	}
+	return result, nil
 }
 
-func (s *Store) Versions(id model.Id) ([]model.Version, error) {
-	vs, err := s.client.LRange(context.Background(), id.String(), 0, -1).Result()
+func (s *Store) Versions(ctx context.Context, id model.Id) ([]model.Version, error) {
+	vs, err := s.client.LRange(ctx, id.String(), 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
 
 	versions := make([]model.Version, len(vs))
-	for i, v := range vs {
+	for i, raw := range vs {
+		rec, err := decodeRecord(raw)
+		if err != nil {
+			return nil, fmt.Errorf("decoding version record for %s: %w", id.String(), err)
+		}
 		versions[i] = model.Version{
-			Id:     model.VersionId(i + 1),
-			Hash:   v,
-			When:   time.Now(),
-			Latest: false,
+			Id:              model.VersionId(i + 1),
+			Hash:            rec.Hash,
+			When:            rec.When,
+			Latest:          i == 0,
+			Size:            rec.Size,
+			VersionMetadata: model.VersionMetadata{ContentType: rec.ContentType, Author: rec.Author},
 		}
 	}
-	if len(versions) > 0 {
-		versions[0].Latest = true
-	}
 
 	return versions, nil
 }
 
-func (s *Store) Delete(id model.Id) error {
-	versions, err := s.client.LRange(context.Background(), id.String(), 0, -1).Result()
+func (s *Store) Delete(ctx context.Context, id model.Id) error {
+	vs, err := s.client.LRange(ctx, id.String(), 0, -1).Result()
 	if err != nil {
 		return err
 	}
 
-	if _, err := s.client.Del(context.Background(), id.String()).Result(); err != nil {
+	if _, err := s.client.Del(ctx, id.String()).Result(); err != nil {
 		return err
 	}
 
-	if _, err := s.client.Del(context.Background(), versions...).Result(); err != nil {
-		return err
+	for _, raw := range vs {
+		rec, err := decodeRecord(raw)
+		if err != nil {
+			return fmt.Errorf("decoding version record for %s: %w", id.String(), err)
+		}
+		if err := s.content.Release(ctx, rec.Hash); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (s *Store) DeleteVersion(id model.Id, version model.VersionId) error {
-	element, err := s.client.LIndex(context.Background(), id.String(), int64(version)).Result()
+// DeleteVersion WATCHes id's version list so the record it reads via
+// LIndex is the same one it removes via LRem -- without that, a
+// concurrent write could shift the list between the two calls and
+// LRem would remove the wrong entry. The refcount release happens
+// after the transaction commits, the same way Delete's does.
+func (s *Store) DeleteVersion(ctx context.Context, id model.Id, version model.VersionId) error {
+	key := id.String()
+	var hash string
+	txf := func(tx *rdb.Tx) error {
+		raw, err := tx.LIndex(ctx, key, int64(version)).Result()
+		if err != nil {
+			if err == rdb.Nil {
+				return store.ErrVersionNotFound
+			}
+			return err
+		}
+		rec, err := decodeRecord(raw)
+		if err != nil {
+			return fmt.Errorf("decoding version record for %s: %w", id.String(), err)
+		}
+		hash = rec.Hash
+
+		_, err = tx.TxPipelined(ctx, func(pipe rdb.Pipeliner) error {
+			pipe.LRem(ctx, key, 1, raw)
+			return nil
+		})
+		return err
+	}
+
+	if err := s.client.Watch(ctx, txf, key); err != nil {
+		return err
+	}
+	return s.content.Release(ctx, hash)
+}
+
+func (s *Store) Migrate(ctx context.Context, id model.Id, dst store.BlobStore) error {
+	versions, err := s.Versions(ctx, id)
 	if err != nil {
-		if err == rdb.Nil {
-			return store.ErrVersionNotFound
+		return err
+	}
+
+	for i := len(versions) - 1; i >= 0; i-- { // oldest first
+		content, err := s.GetVersion(ctx, id, versions[i].Id-1)
+		if err != nil {
+			return fmt.Errorf("migrate %s: reading version %d: %w", id.String(), versions[i].Id, err)
+		}
+		// Carry the original When across explicitly -- Add would
+		// otherwise stamp the migration time as this version's write
+		// time, losing the real history chunk0-5 added VersionMetadata
+		// to preserve.
+		meta := versions[i].VersionMetadata
+		meta.When = versions[i].When
+		if err := dst.Add(ctx, id, content, meta); err != nil {
+			return fmt.Errorf("migrate %s: writing version %d: %w", id.String(), versions[i].Id, err)
 		}
 	}
-	return s.client.Del(context.Background(), element).Err()
+
+	return s.Delete(ctx, id)
 }
 
 func (s *Store) Hash(contents []byte) string {
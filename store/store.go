@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"errors"
 
 	"github.com/alexsward/steel/model"
@@ -8,24 +9,48 @@ import (
 
 var (
 	ErrVersionNotFound = errors.New("version not found")
+	// ErrVersionConflict is returned by CompareAndSet when the head
+	// version has moved since the caller last read it, i.e. someone
+	// else wrote in between. Callers should re-read with
+	// GetWithVersion and retry the read-modify-write against the new
+	// version.
+	ErrVersionConflict = errors.New("version conflict: head has moved since read")
 )
 
+// BlobStore methods all take a context so a slow partition can be
+// bounded by a caller-supplied deadline or cancelled outright, instead
+// of blocking a redcon worker indefinitely.
 type BlobStore interface {
-	Keys(pattern string) ([]model.Id, error)
-	Add(id model.Id, content []byte) error
-	Get(id model.Id) ([]byte, error)
-	GetVersion(id model.Id, version model.VersionId) ([]byte, error)
-	Versions(id model.Id) ([]model.Version, error)
-	Delete(id model.Id) error
-	DeleteVersion(id model.Id, version model.VersionId) error
+	Keys(ctx context.Context, pattern string) ([]model.Id, error)
+	Add(ctx context.Context, id model.Id, content []byte, meta model.VersionMetadata) error
+	Get(ctx context.Context, id model.Id) ([]byte, error)
+	GetVersion(ctx context.Context, id model.Id, version model.VersionId) ([]byte, error)
+	// GetWithVersion returns the current content of id along with the
+	// VersionId it was read at, for use as the expected version in a
+	// later CompareAndSet.
+	GetWithVersion(ctx context.Context, id model.Id) ([]byte, model.VersionId, error)
+	// CompareAndSet writes content as the new head version of id only
+	// if expected still matches the current head, returning the new
+	// VersionId on success or ErrVersionConflict if another writer won
+	// the race.
+	CompareAndSet(ctx context.Context, id model.Id, expected model.VersionId, content []byte, meta model.VersionMetadata) (model.VersionId, error)
+	Versions(ctx context.Context, id model.Id) ([]model.Version, error)
+	Delete(ctx context.Context, id model.Id) error
+	DeleteVersion(ctx context.Context, id model.Id, version model.VersionId) error
 	Hash(contents []byte) string
+	// Migrate streams every version of id from this store to dst, oldest
+	// first so dst's version ordering matches the source, then removes
+	// id from this store. It is used by cluster rebalancing to move a
+	// key's ownership from one BlobStore to another.
+	Migrate(ctx context.Context, id model.Id, dst BlobStore) error
 }
 
 type StoreType int
 
 const (
-	StoreTypeRedis = 0
-	StoreTypeKeyDB = 1
+	StoreTypeRedis  = 0
+	StoreTypeKeyDB  = 1
+	StoreTypeBadger = 2
 )
 
 type StoreOpts[T BlobStore] func(T) error